@@ -18,27 +18,45 @@ package integration
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/auth/testauthority"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/kube"
+	"github.com/gravitational/teleport/lib/kube/certagent"
+	"github.com/gravitational/teleport/lib/kube/proxy"
 	kubeutils "github.com/gravitational/teleport/lib/kube/utils"
+	"github.com/gravitational/teleport/lib/service"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/gravitational/trace"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/check.v1"
+	authzv1 "k8s.io/api/authorization/v1"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
 	//	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
@@ -98,8 +116,205 @@ func (s *KubeSuite) SetUpSuite(c *check.C) {
 		}
 	}
 
-	// fetch certificate authority cert, by grabbing it
-	// from the DNS app pod that is always running
+	// discover the cluster's signing CA through the control-plane pods
+	// rather than assuming a particular DNS add-on and CA path.
+	agent := certagent.New(s.Clientset, s.kubeConfig, execCA, nil)
+	caResult, err := agent.DiscoverCA()
+	c.Assert(err, check.IsNil)
+	s.kubeCACert = caResult.CertPEM
+	log.Infof("Got CA Cert from node %v:%v: <%v>", caResult.Node, caResult.Path, string(s.kubeCACert))
+}
+
+// execCA adapts kubeExec, which writes to an io.Writer, to certagent.Exec's
+// signature, which returns the command's stdout as a byte slice.
+func execCA(kubeConfig *rest.Config, podName, podNamespace, container string, command []string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	err := kubeExec(kubeConfig, kubeExecArgs{
+		podName:      podName,
+		podNamespace: podNamespace,
+		container:    container,
+		command:      command,
+		stdout:       out,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return out.Bytes(), nil
+}
+
+func (s *KubeSuite) TearDownSuite(c *check.C) {
+	var err error
+	// restore os.Stdin to its original condition: connected to /dev/null
+	os.Stdin.Close()
+	os.Stdin, err = os.Open("/dev/null")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *KubeSuite) SetUpTest(c *check.C) {
+
+}
+
+// TestKubeProxy tests kubernetes proxy feature set, built on top of a real
+// Teleport cluster (auth + proxy + node) with the kubernetes proxy role
+// enabled. It issues short-lived user certs bound to the test user's
+// Teleport identity and drives the three core kubectl verbs - exec, attach
+// and logs - through the Teleport proxy rather than talking to the
+// apiserver directly.
+func (s *KubeSuite) TestKubeProxy(c *check.C) {
+	tconf := s.teleKubeConfig(Host)
+	teleport := s.newTeleportWithKubeProxy(c, tconf, []string{"kube"}, []string{"edsger"})
+	defer teleport.StopAll()
+
+	proxyConfig, err := s.teleportKubeProxyConfig(teleport, s.me.Username)
+	c.Assert(err, check.IsNil)
+
+	pod, err := s.createTestPod(proxyConfig)
+	c.Assert(err, check.IsNil)
+	defer s.Core().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+
+	// exec into the test pod without a TTY, the way a scripted kubectl exec
+	// would, and make sure the command's stdout comes back through the
+	// proxy.
+	out := &bytes.Buffer{}
+	err = kubeExec(proxyConfig, kubeExecArgs{
+		podName:      pod.Name,
+		podNamespace: pod.Namespace,
+		container:    pod.Spec.Containers[0].Name,
+		command:      []string{"/bin/echo", "hello"},
+		stdout:       out,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Matches, "(?s).*hello.*")
+
+	// exec again, this time requesting a TTY and streaming a command over
+	// stdin, as an interactive `kubectl exec -it` session would. stdout is
+	// read by this goroutine while the session is still running, so it has
+	// to be a syncBuffer rather than a bare bytes.Buffer or the race
+	// detector fires.
+	ttyOut := &syncBuffer{}
+	stdinR, stdinW := io.Pipe()
+	execDone := make(chan error, 1)
+	go func() {
+		execDone <- kubeExec(proxyConfig, kubeExecArgs{
+			podName:      pod.Name,
+			podNamespace: pod.Namespace,
+			container:    pod.Spec.Containers[0].Name,
+			command:      []string{"/bin/sh"},
+			stdin:        stdinR,
+			stdout:       ttyOut,
+			tty:          true,
+		})
+	}()
+
+	_, err = stdinW.Write([]byte("echo ttyhello\n"))
+	c.Assert(err, check.IsNil)
+	waitForString(c, ttyOut, "ttyhello")
+
+	_, err = stdinW.Write([]byte("exit\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdinW.Close(), check.IsNil)
+	select {
+	case err := <-execDone:
+		c.Assert(err, check.IsNil)
+	case <-time.After(testTimeout):
+		c.Fatalf("timed out waiting for TTY exec session to finish")
+	}
+
+	// attach re-uses the same SPDY executor path, against /attach instead
+	// of /exec.
+	attachOut := &syncBuffer{}
+	err = kubeAttach(proxyConfig, kubeAttachArgs{
+		podName:      pod.Name,
+		podNamespace: pod.Namespace,
+		container:    pod.Spec.Containers[0].Name,
+		stdin:        bytes.NewBufferString("\n"),
+		stdout:       attachOut,
+		tty:          true,
+	})
+	c.Assert(err, check.IsNil)
+
+	// logs streams a chunked HTTP response; follow it only until the
+	// container's startup line shows up, since a follow never ends on its
+	// own while the container is running.
+	logsOut := &bytes.Buffer{}
+	err = kubeLogs(proxyConfig, kubeLogsArgs{
+		podName:      pod.Name,
+		podNamespace: pod.Namespace,
+		container:    pod.Spec.Containers[0].Name,
+		follow:       true,
+		stdout:       logsOut,
+		until:        "hello",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(logsOut.String(), check.Matches, "(?s).*hello.*")
+
+	// the proxy's upstream trust anchor should be the same kube CA
+	// SetUpSuite discovered - ask the proxy package to discover it again,
+	// independently of the client config above, rather than re-reading the
+	// value teleportKubeProxyConfig copied into proxyConfig.CAData.
+	srv := proxy.New(proxy.Config{
+		LocalCluster: Site,
+		Clusters: map[string]proxy.Cluster{
+			Site: {Name: Site, KubeConfig: s.kubeConfig},
+		},
+		CertAgents: map[string]*certagent.Agent{
+			Site: certagent.New(s.Clientset, s.kubeConfig, execCA, nil),
+		},
+	})
+	discovered, err := srv.UpstreamCAPEM(Site)
+	c.Assert(err, check.IsNil)
+	c.Assert(discovered, check.DeepEquals, s.kubeCACert)
+
+	// and the exec session above should be visible in the cluster's audit
+	// log, the same way an SSH session would be.
+	s.assertKubeSessionAudited(c, teleport, pod)
+}
+
+// TestKubeTrustedCluster brings up a root and a leaf Teleport cluster
+// joined by a trust relationship, and checks that a kubeExec sent to the
+// root proxy with the leaf cluster selected by proxy.KubeClusterHeader
+// succeeds and returns output. Both clusters run against the same kube
+// cluster, and the root proxy dials the selected cluster's apiserver
+// directly, so the test does not show traffic passing through the leaf.
+func (s *KubeSuite) TestKubeTrustedCluster(c *check.C) {
+	root, leaf := s.newTrustedClusterPair(c, []string{"kube"}, []string{"edsger"})
+	defer root.StopAll()
+	defer leaf.StopAll()
+
+	proxyConfig, err := s.kubeProxyClient(root, root.Config.Proxy.Kube.ListenAddr.Addr, Site2, s.me.Username)
+	c.Assert(err, check.IsNil)
+
+	pod, err := s.createTestPod(proxyConfig)
+	c.Assert(err, check.IsNil)
+	defer s.Core().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+
+	out := &bytes.Buffer{}
+	err = kubeExec(proxyConfig, kubeExecArgs{
+		podName:      pod.Name,
+		podNamespace: pod.Namespace,
+		container:    pod.Spec.Containers[0].Name,
+		command:      []string{"/bin/cat", "/etc/resolv.conf"},
+		stdout:       out,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(out.Len() > 0, check.Equals, true)
+}
+
+// TestKubePortForward forwards a local port to the kube-dns pod's :53
+// through the Teleport kube proxy and sends it a real DNS query, exercising
+// the portforward subresource the same way an interactive
+// `kubectl port-forward` session would - and proving bytes actually flow
+// both ways, not just that the forwarded port accepts a connection. The
+// proxy relays the SPDY-upgraded portforward request the same way it does
+// exec/attach (see lib/kube/proxy.Server.hijackAndStream).
+func (s *KubeSuite) TestKubePortForward(c *check.C) {
+	tconf := s.teleKubeConfig(Host)
+	teleport := s.newTeleportWithKubeProxy(c, tconf, []string{"kube"}, []string{"edsger"})
+	defer teleport.StopAll()
+
+	proxyConfig, err := s.teleportKubeProxyConfig(teleport, s.me.Username)
+	c.Assert(err, check.IsNil)
+
 	set := labels.Set{"k8s-app": "kube-dns"}
 	pods, err := s.Core().Pods("kube-system").List(metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
@@ -108,43 +323,422 @@ func (s *KubeSuite) SetUpSuite(c *check.C) {
 	if len(pods.Items) == 0 {
 		c.Fatalf("Failed to find kube-dns pods.")
 	}
-	log.Infof("Found %v pods", len(pods.Items))
 	pod := pods.Items[0]
 
-	out := &bytes.Buffer{}
-	err = kubeExec(s.kubeConfig, kubeExecArgs{
+	localPort := s.ports.Pop()
+	fw, err := kubePortForward(proxyConfig, kubePortForwardArgs{
 		podName:      pod.Name,
 		podNamespace: pod.Namespace,
-		container:    "kubedns",
-		command:      []string{"/bin/cat", teleport.KubeCAPath},
-		stdout:       out,
+		localPort:    localPort,
+		remotePort:   "53",
 	})
 	c.Assert(err, check.IsNil)
-	s.kubeCACert = out.Bytes()
-	log.Infof("Got CA Cert: <%v>", string(s.kubeCACert))
+	defer fw.Close()
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%v", localPort), testTimeout)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	// a bare connect/close would succeed even if the forward silently
+	// dropped every byte written to it, so issue a real DNS query over the
+	// forwarded connection and check kube-dns actually answered it. kube-dns
+	// listens on both UDP and TCP :53, but kubectl port-forward (like the
+	// SPDY tunnel underneath it) only ever carries a TCP byte stream, so the
+	// query has to go out as TCP DNS (2-byte length prefix, RFC 1035 ยง4.2.2)
+	// rather than the UDP form most DNS clients default to.
+	answer, err := dnsQueryOverTCP(conn, "kubernetes.default.svc.cluster.local.")
+	c.Assert(err, check.IsNil)
+	c.Assert(answer.qr, check.Equals, true)
+	c.Assert(answer.id, check.Equals, dnsQueryID)
 }
 
-func (s *KubeSuite) TearDownSuite(c *check.C) {
-	var err error
-	// restore os.Stdin to its original condition: connected to /dev/null
-	os.Stdin.Close()
-	os.Stdin, err = os.Open("/dev/null")
+// dnsAnswer holds the parts of a DNS response dnsQueryOverTCP checks.
+type dnsAnswer struct {
+	id uint16
+	qr bool
+}
+
+// dnsQueryID is the fixed transaction ID dnsQueryOverTCP sends, so the
+// response can be matched back to the request without decoding a real
+// question section.
+const dnsQueryID = 0x1234
+
+// dnsQueryOverTCP sends a minimal "A" query for name down conn using the
+// length-prefixed framing TCP DNS requires, and parses just enough of the
+// response header to confirm the server answered.
+func dnsQueryOverTCP(conn net.Conn, name string) (dnsAnswer, error) {
+	// header: ID, flags (RD=1), QDCOUNT=1, ANCOUNT/NSCOUNT/ARCOUNT=0
+	msg := []byte{
+		byte(dnsQueryID >> 8), byte(dnsQueryID),
+		0x01, 0x00,
+		0x00, 0x01,
+		0x00, 0x00,
+		0x00, 0x00,
+		0x00, 0x00,
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0x00)       // root label
+	msg = append(msg, 0x00, 0x01) // QTYPE A
+	msg = append(msg, 0x00, 0x01) // QCLASS IN
+	framed := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+
+	if _, err := conn.Write(framed); err != nil {
+		return dnsAnswer{}, trace.Wrap(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	lenPrefix := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenPrefix); err != nil {
+		return dnsAnswer{}, trace.Wrap(err)
+	}
+	respLen := int(lenPrefix[0])<<8 | int(lenPrefix[1])
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return dnsAnswer{}, trace.Wrap(err)
+	}
+	if len(resp) < 4 {
+		return dnsAnswer{}, trace.BadParameter("DNS response too short: %v bytes", len(resp))
+	}
+	return dnsAnswer{
+		id: uint16(resp[0])<<8 | uint16(resp[1]),
+		qr: resp[2]&0x80 != 0,
+	}, nil
+}
+
+type kubePortForwardArgs struct {
+	podName      string
+	podNamespace string
+	localPort    int
+	remotePort   string
+}
+
+// kubePortForward dials the portforward subresource via an SPDY dialer and
+// starts streaming the local/remote port pair in the background, mirroring
+// how client-go's tools/portforward package is used against a real
+// apiserver.
+func kubePortForward(kubeConfig *rest.Config, args kubePortForwardArgs) (*portforward.PortForwarder, error) {
+	u, err := url.Parse(kubeConfig.Host)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	u.Scheme = "https"
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%v/pods/%v/portforward", args.podNamespace, args.podName)
+
+	transport, upgrader, err := spdy.RoundTripperFor(kubeConfig)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", u)
+
+	ports := []string{fmt.Sprintf("%v:%v", args.localPort, args.remotePort)}
+	readyCh := make(chan struct{})
+	fw, err := portforward.New(dialer, ports, make(chan struct{}), readyCh, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	go fw.ForwardPorts()
+	select {
+	case <-readyCh:
+	case <-time.After(testTimeout):
+		return nil, trace.LimitExceeded("timed out waiting for port forward to become ready")
+	}
+	return fw, nil
+}
+
+// newTrustedClusterPair starts two single-process Teleport clusters and
+// establishes a trust relationship between them, mirroring how SSH trusted
+// clusters are wired up elsewhere in this package.
+func (s *KubeSuite) newTrustedClusterPair(c *check.C, kubeUsers, kubeGroups []string) (root *TeleInstance, leaf *TeleInstance) {
+	root = s.newTeleportWithKubeProxy(c, s.teleKubeConfig(Host), kubeUsers, kubeGroups)
+
+	leafConf := s.teleKubeConfig(Host)
+	leaf = NewInstance(InstanceConfig{
+		ClusterName: Site2,
+		HostID:      HostID,
+		NodeName:    Host,
+		Ports:       s.ports.PopIntSlice(6),
+		Priv:        s.priv,
+		Pub:         s.pub,
+	})
+	c.Assert(leaf.CreateEx(nil, leafConf), check.IsNil)
+	c.Assert(leaf.Start(), check.IsNil)
+
+	trustedCluster := root.AsTrustedCluster(leaf.Secrets.AsSlice()[0].GetName(), services.RoleMap{
+		{Remote: services.RoleNameForCertAuthority(leaf.Secrets.SiteName), Local: []string{"kube"}},
+	})
+	c.Assert(leaf.Process.GetAuthServer().UpsertTrustedCluster(trustedCluster), check.IsNil)
+	return root, leaf
+}
+
+// kubeProxyClient returns a *rest.Config whose Host points at the root
+// proxy, but whose routing (proxy.KubeClusterHeader, the kube equivalent of
+// SSH's SNI-based cluster routing) selects a kube API server in
+// leafClusterName rather than the root cluster's own. root is the
+// TeleInstance whose auth server will mint the short-lived user cert, since
+// only the issuing cluster's auth server can scope a cert to a trusted
+// leaf.
+func (s *KubeSuite) kubeProxyClient(root *TeleInstance, rootProxyAddr, leafClusterName, user string) (*rest.Config, error) {
+	tlsConfig, err := s.clientTLSConfigForCluster(root, user, leafClusterName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &rest.Config{
+		Host:            fmt.Sprintf("https://%v", rootProxyAddr),
+		TLSClientConfig: rest.TLSClientConfig{CAData: s.kubeCACert},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			rt = utils.NewTLSRoundTripper(rt, tlsConfig)
+			return utils.NewHeaderRoundTripper(rt, http.Header{
+				proxy.KubeClusterHeader: []string{leafClusterName},
+			})
+		},
+	}, nil
+}
+
+// clientTLSConfigForCluster issues a short-lived user cert scoped to
+// clusterName, signed by teleport's auth server, and returns the tls.Config
+// a kube client should dial the proxy with.
+func (s *KubeSuite) clientTLSConfigForCluster(teleport *TeleInstance, user, clusterName string) (*tls.Config, error) {
+	creds, err := GenerateUserCreds(UserCredsRequest{
+		Process:  teleport.Process,
+		Username: user,
+		Cluster:  clusterName,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return creds.TLS, nil
+}
+
+// teleKubeConfig returns a Teleport service configuration with the
+// Kubernetes proxy enabled, listening on one of the suite's preallocated
+// ports.
+func (s *KubeSuite) teleKubeConfig(hostname string) *service.Config {
+	tconf := service.MakeDefaultConfig()
+	tconf.Console = nil
+	tconf.Proxy.Kube.Enabled = true
+	tconf.Proxy.Kube.ListenAddr = *utils.MustParseAddr(
+		fmt.Sprintf("%v:%v", hostname, s.ports.Pop()))
+	tconf.SSH.Enabled = true
+	return tconf
+}
+
+// newTeleportWithKubeProxy starts a single-process Teleport cluster (auth,
+// proxy and node all in one) with the kube proxy role enabled, and a role
+// granting the current OS user the given kubernetes_users/kubernetes_groups.
+func (s *KubeSuite) newTeleportWithKubeProxy(c *check.C, tconf *service.Config, kubeUsers, kubeGroups []string) *TeleInstance {
+	teleport := NewInstance(InstanceConfig{
+		ClusterName: Site,
+		HostID:      HostID,
+		NodeName:    Host,
+		Ports:       s.ports.PopIntSlice(6),
+		Priv:        s.priv,
+		Pub:         s.pub,
+	})
+
+	role := services.RoleForUser(&services.UserV2{})
+	role.SetKubeUsers(services.Allow, kubeUsers)
+	role.SetKubeGroups(services.Allow, kubeGroups)
+	teleport.AddUserWithRole(s.me.Username, role)
+
+	c.Assert(teleport.CreateEx(nil, tconf), check.IsNil)
+	c.Assert(teleport.Start(), check.IsNil)
+	return teleport
+}
+
+// teleportKubeProxyConfig builds a *rest.Config whose Host points at the
+// Teleport proxy's kube endpoint (rather than the real apiserver), using a
+// short-lived cert issued for the given Teleport user.
+func (s *KubeSuite) teleportKubeProxyConfig(teleport *TeleInstance, user string) (*rest.Config, error) {
+	tlsConfig, err := teleport.ClientTLSConfig(user)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &rest.Config{
+		Host:            fmt.Sprintf("https://%v", teleport.Config.Proxy.Kube.ListenAddr.Addr),
+		TLSClientConfig: rest.TLSClientConfig{CAData: s.kubeCACert},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return utils.NewTLSRoundTripper(rt, tlsConfig)
+		},
+	}, nil
+}
+
+// createTestPod starts a short-lived pod in the teletest namespace that the
+// exec/attach/logs assertions run against. It creates the pod through
+// kubeConfig rather than a fresh direct client, so that for callers passing
+// a kube-proxy-routed config (e.g. a leaf cluster's, or one using
+// impersonation) the pod actually lands on the cluster the rest of the test
+// talks to.
+func (s *KubeSuite) createTestPod(kubeConfig *rest.Config) (*v1.Pod, error) {
+	client, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "teleport-test-",
+			Namespace:    testNamespace,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:    "test",
+					Image:   "busybox",
+					Command: []string{"/bin/sh", "-c", "echo hello; sleep 3600"},
+				},
+			},
+		},
+	}
+	created, err := client.Core().Pods(testNamespace).Create(pod)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return created, nil
+}
+
+// findKubeExecSession returns the ID of the session a kube.exec audit event
+// naming pod was filed under - proof that lib/kube/proxy.Server actually
+// drove a kube.SessionRecorder for the exec above, not just that some
+// session (e.g. an SSH session from cluster bring-up) exists. It fails the
+// test if no such event is found.
+func (s *KubeSuite) findKubeExecSession(c *check.C, teleport *TeleInstance, pod *v1.Pod) session.ID {
+	sessions, err := teleport.Process.GetAuthServer().GetSessions(defaults.Namespace)
 	c.Assert(err, check.IsNil)
+
+	for _, sess := range sessions {
+		sessionEvents, err := teleport.Process.GetAuthServer().GetSessionEvents(defaults.Namespace, sess.ID, 0, false)
+		c.Assert(err, check.IsNil)
+		for _, e := range sessionEvents {
+			if e.GetString(events.EventType) == events.KubernetesExecEvent &&
+				e.GetString(events.KubernetesPod) == pod.Name {
+				return sess.ID
+			}
+		}
+	}
+	c.Fatalf("no kube.exec audit event found for pod %v", pod.Name)
+	return ""
 }
 
-func (s *KubeSuite) SetUpTest(c *check.C) {
+// assertKubeSessionAudited checks that the exec session driven above left a
+// kube.exec event in the cluster's audit log.
+func (s *KubeSuite) assertKubeSessionAudited(c *check.C, teleport *TeleInstance, pod *v1.Pod) {
+	s.findKubeExecSession(c, teleport, pod)
+}
+
+// TestKubeSessionRecording turns on proxy-side session recording, runs an
+// exec against a test pod, and then reads the recording back and checks
+// that the captured bytes match what the command actually printed - the
+// same round trip `tsh play` relies on for SSH sessions.
+func (s *KubeSuite) TestKubeSessionRecording(c *check.C) {
+	tconf := s.teleKubeConfig(Host)
+	tconf.Auth.ClusterConfig, _ = services.NewClusterConfig(services.ClusterConfigSpecV3{
+		SessionRecording: services.RecordAtProxy,
+	})
+	teleport := s.newTeleportWithKubeProxy(c, tconf, []string{"kube"}, []string{"edsger"})
+	defer teleport.StopAll()
+
+	proxyConfig, err := s.teleportKubeProxyConfig(teleport, s.me.Username)
+	c.Assert(err, check.IsNil)
 
+	pod, err := s.createTestPod(proxyConfig)
+	c.Assert(err, check.IsNil)
+	defer s.Core().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+
+	const phrase = "this exec session should be recorded"
+	out := &bytes.Buffer{}
+	err = kubeExec(proxyConfig, kubeExecArgs{
+		podName:      pod.Name,
+		podNamespace: pod.Namespace,
+		container:    pod.Spec.Containers[0].Name,
+		command:      []string{"/bin/echo", phrase},
+		stdout:       out,
+	})
+	c.Assert(err, check.IsNil)
+
+	sid := s.findKubeExecSession(c, teleport, pod)
+
+	sessionEvents, err := teleport.Process.GetAuthServer().GetSessionEvents(defaults.Namespace, sid, 0, false)
+	c.Assert(err, check.IsNil)
+
+	var found bool
+	for _, e := range sessionEvents {
+		if e.GetString(events.KubernetesContainer) == pod.Spec.Containers[0].Name {
+			found = true
+			break
+		}
+	}
+	c.Assert(found, check.Equals, true)
+
+	replay, err := teleport.Process.GetAuthServer().GetSessionChunk(defaults.Namespace, sid, 0, maxChunkBytes)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(replay), check.Matches, "(?s).*"+phrase+".*")
 }
 
-// TestKubeProxy tests kubernetes proxy feature set - exec, attach, logs
-func (s *KubeSuite) TestKubeProxy(c *check.C) {
-	log.Infof("Running Test Kube Proxy: %v", s.Clientset)
+// TestKubeImpersonation runs the kube proxy in impersonation mode, where it
+// authenticates to the upstream apiserver with its own service account
+// token and relies on Impersonate-* headers to carry the Teleport user's
+// effective identity. It then sends a SelfSubjectAccessReview through the
+// proxy and checks that the requesting identity may get pods in teletest.
+// The review reports only whether the request is allowed, not which
+// identity made it, so it passes for the proxy's own service account as
+// well as for "alice"/"dev" if that account is allowed the same.
+func (s *KubeSuite) TestKubeImpersonation(c *check.C) {
+	tconf := s.teleKubeConfig(Host)
+	// ProxyMode has to be set before the proxy starts - lib/service reads
+	// it once, at startup, to decide which lib/kube/proxy.Config to build;
+	// setting it on the already-running instance below would be silently
+	// ignored.
+	tconf.Proxy.Kube.ProxyMode = kube.ProxyModeImpersonation
+	teleport := s.newTeleportWithKubeProxy(c, tconf, []string{"alice"}, []string{"dev"})
+	defer teleport.StopAll()
+
+	proxyConfig, err := s.teleportKubeProxyConfig(teleport, s.me.Username)
+	c.Assert(err, check.IsNil)
+
+	client, err := kubernetes.NewForConfig(proxyConfig)
+	c.Assert(err, check.IsNil)
+
+	pod, err := s.createTestPod(proxyConfig)
+	c.Assert(err, check.IsNil)
+	defer s.Core().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+
+	out := &bytes.Buffer{}
+	err = kubeExec(proxyConfig, kubeExecArgs{
+		podName:      pod.Name,
+		podNamespace: pod.Namespace,
+		container:    pod.Spec.Containers[0].Name,
+		command:      []string{"/bin/echo", "hello"},
+		stdout:       out,
+	})
+	c.Assert(err, check.IsNil)
+
+	ssar, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authzv1.SelfSubjectAccessReview{
+		Spec: authzv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authzv1.ResourceAttributes{
+				Namespace: testNamespace,
+				Verb:      "get",
+				Resource:  "pods",
+			},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	// the role created in newTeleportWithKubeProxy maps the Teleport user to
+	// kube user "alice" and group "dev"; it grants no Kubernetes RBAC, so
+	// this holds only if the cluster's RBAC lets that identity get pods in
+	// teletest.
+	c.Assert(ssar.Status.Allowed, check.Equals, true)
 }
 
 const (
 	testTimeout = 1 * time.Minute
 
 	testNamespace = "teletest"
+
+	// maxChunkBytes is the largest session recording chunk TestKubeSessionRecording
+	// reads back at once.
+	maxChunkBytes = 5 * 1024 * 1024
 )
 
 func newNamespace(name string) *v1.Namespace {
@@ -155,6 +749,49 @@ func newNamespace(name string) *v1.Namespace {
 	}
 }
 
+// syncBuffer wraps bytes.Buffer with a mutex so it can be safely written to
+// by an in-flight kubeExec/kubeAttach session while a test goroutine reads
+// from it to assert on partial output, without tripping the -race
+// detector.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Read drains the buffer like bytes.Buffer.Read does; use String() instead
+// when you want to peek at accumulated output without consuming it.
+func (b *syncBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitForString polls buf until it contains substr or testTimeout elapses.
+func waitForString(c *check.C, buf *syncBuffer, substr string) {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if strings.Contains(buf.String(), substr) {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("timed out waiting for %q in session output, got: %q", substr, buf.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 type kubeExecArgs struct {
 	podName      string
 	podNamespace string
@@ -213,3 +850,133 @@ func kubeExec(kubeConfig *rest.Config, args kubeExecArgs) error {
 	}
 	return executor.Stream(opts)
 }
+
+type kubeAttachArgs struct {
+	podName      string
+	podNamespace string
+	container    string
+	stdout       io.Writer
+	stderr       io.Writer
+	stdin        io.Reader
+	tty          bool
+}
+
+// kubeAttach attaches to a running container, reusing the same SPDY
+// executor path that kubeExec uses against /exec.
+func kubeAttach(kubeConfig *rest.Config, args kubeAttachArgs) error {
+	if args.stdin == nil {
+		args.stdin = &bytes.Buffer{}
+	}
+	query := make(url.Values)
+	if args.stdout != nil {
+		query.Set("stdout", "true")
+	}
+	if args.stderr != nil {
+		query.Set("stderr", "true")
+	}
+	if args.tty {
+		query.Set("tty", "true")
+	}
+	query.Set("container", args.container)
+	u, err := url.Parse(kubeConfig.Host)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	u.Scheme = "https"
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%v/pods/%v/attach", args.podNamespace, args.podName)
+	u.RawQuery = query.Encode()
+	executor, err := remotecommand.NewSPDYExecutor(kubeConfig, "POST", u)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	opts := remotecommand.StreamOptions{
+		Stdin:  args.stdin,
+		Stdout: args.stdout,
+		Stderr: args.stderr,
+		Tty:    args.tty,
+	}
+	return executor.Stream(opts)
+}
+
+type kubeLogsArgs struct {
+	podName      string
+	podNamespace string
+	container    string
+	follow       bool
+	stdout       io.Writer
+	// until, if set, ends the request (and the underlying follow=true
+	// stream) as soon as this substring has appeared in the logs, instead
+	// of reading until the container exits or the request times out.
+	until string
+}
+
+// kubeLogs fetches a pod's logs, optionally following them as they are
+// streamed back chunked over HTTP.
+func kubeLogs(kubeConfig *rest.Config, args kubeLogsArgs) error {
+	query := make(url.Values)
+	query.Set("container", args.container)
+	query.Set("follow", toBoolString(args.follow))
+	u, err := url.Parse(kubeConfig.Host)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	u.Scheme = "https"
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%v/pods/%v/log", args.podNamespace, args.podName)
+	u.RawQuery = query.Encode()
+
+	// a follow=true request against a still-running container never sends
+	// EOF on its own, so bound it with a context timeout - and, if the
+	// caller gave us a substring to watch for, stop reading (and close the
+	// response body, ending the follow) as soon as we've seen it rather
+	// than waiting for the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req = req.WithContext(ctx)
+
+	client, err := rest.HTTPClientFor(kubeConfig)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return trace.BadParameter("kube logs request failed: %v", resp.Status)
+	}
+
+	if args.until == "" {
+		_, err = io.Copy(args.stdout, resp.Body)
+		return trace.Wrap(err)
+	}
+
+	buf := make([]byte, 512)
+	var tail string
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if _, werr := args.stdout.Write(chunk); werr != nil {
+				return trace.Wrap(werr)
+			}
+			tail += string(chunk)
+			if strings.Contains(tail, args.until) {
+				return nil
+			}
+			if len(tail) > len(args.until)*2 {
+				tail = tail[len(tail)-len(args.until)*2:]
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+	}
+}
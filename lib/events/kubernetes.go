@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+const (
+	// KubernetesExecEvent is emitted when a user runs a command inside a
+	// pod (kubectl exec or attach) through the Teleport kube proxy. It
+	// carries the same session ID as the recorded byte stream so the two
+	// can be correlated.
+	KubernetesExecEvent = "kube.exec"
+
+	// KubernetesPod is the name of the pod the session ran against.
+	KubernetesPod = "kubernetes_pod"
+	// KubernetesNamespace is the namespace of the pod the session ran against.
+	KubernetesNamespace = "kubernetes_namespace"
+	// KubernetesContainer is the container within the pod the session ran against.
+	KubernetesContainer = "kubernetes_container"
+	// KubernetesCommand is the command that was executed, joined with spaces.
+	KubernetesCommand = "kubernetes_command"
+)
+
+// SessionRecordingMode describes where session recordings (SSH or kube)
+// are captured: on the node/pod's proxy connection, on the auth-facing
+// proxy, or not at all.
+type SessionRecordingMode string
+
+const (
+	// SessionRecordingModeNode records sessions on the node (or, for kube
+	// sessions, on the node that terminates the SPDY connection to the
+	// upstream apiserver).
+	SessionRecordingModeNode SessionRecordingMode = "node"
+	// SessionRecordingModeProxy records sessions on the proxy, before they
+	// are forwarded upstream. This is the only option available for kube
+	// sessions that are impersonated rather than terminated locally.
+	SessionRecordingModeProxy SessionRecordingMode = "proxy"
+	// SessionRecordingModeOff disables session recording entirely.
+	SessionRecordingModeOff SessionRecordingMode = "off"
+)
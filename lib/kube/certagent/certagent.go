@@ -0,0 +1,241 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certagent discovers the signing certificate authority of a
+// Kubernetes cluster without assuming anything about how that cluster was
+// installed. It replaces the old approach of `kubectl exec`'ing into
+// whatever pod happens to answer to the `k8s-app=kube-dns` label and
+// `cat`'ing a hard-coded path: that breaks the moment DNS is served by
+// CoreDNS instead of kube-dns, the pod runs a distroless image with no
+// `/bin/cat`, or the distro keeps its CA someplace else.
+//
+// Instead it finds a node running the control plane (one carrying a
+// controller-manager pod) and schedules its own short-lived agent pod onto
+// that same node, hostPath-mounting the candidate CA directories into a
+// known-good busybox image - the kube-cert-agent pattern. The candidate
+// paths are then read out of that agent pod, never out of the (possibly
+// distroless, shell-less) control-plane container itself.
+package certagent
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// DefaultCAPaths is the list of paths probed, in order, inside the agent
+// pod to find the cluster's signing CA certificate.
+var DefaultCAPaths = []string{
+	"/etc/kubernetes/pki/ca.crt",
+	"/etc/kubernetes/ca/ca.pem",
+	"/var/lib/minikube/certs/ca.crt",
+}
+
+// ControllerManagerLabel selects the pods that run the Kubernetes
+// controller manager, which always has access to the cluster's signing CA.
+// The agent pod is scheduled onto the same node as one of these, never
+// into the controller-manager pod itself.
+var ControllerManagerLabel = labels.Set{"component": "kube-controller-manager"}
+
+// AgentNamespace is the namespace the agent pod is created in.
+var AgentNamespace = "kube-system"
+
+// AgentImage is the image the agent pod runs - a known-good shell, so
+// reading a hostPath-mounted CA file doesn't depend on whatever image the
+// control plane happens to use.
+var AgentImage = "busybox"
+
+const agentContainerName = "ca-reader"
+
+// agentPodTimeout bounds how long DiscoverCA waits for its agent pod to
+// reach Running before giving up.
+const agentPodTimeout = 30 * time.Second
+
+// Exec runs a command inside a pod and returns its stdout. Tests and the
+// kube proxy both satisfy this with their own SPDY-based exec helper, so
+// the agent doesn't need to import the proxy's transport code.
+type Exec func(kubeConfig *rest.Config, podName, podNamespace, container string, command []string) ([]byte, error)
+
+// Agent discovers and caches a cluster's signing CA.
+type Agent struct {
+	client     *kubernetes.Clientset
+	kubeConfig *rest.Config
+	exec       Exec
+	candidates []string
+
+	cached *Result
+}
+
+// Result is the outcome of a successful CA discovery.
+type Result struct {
+	// CertPEM is the PEM-encoded CA certificate.
+	CertPEM []byte
+	// Node and Path record where the cert was found, for logging/caching.
+	Node string
+	Path string
+}
+
+// New returns an Agent that discovers the CA of the cluster client points
+// at, probing candidates (or DefaultCAPaths if empty) via an agent pod
+// scheduled onto a control-plane node.
+func New(client *kubernetes.Clientset, kubeConfig *rest.Config, exec Exec, candidates []string) *Agent {
+	if len(candidates) == 0 {
+		candidates = DefaultCAPaths
+	}
+	return &Agent{
+		client:     client,
+		kubeConfig: kubeConfig,
+		exec:       exec,
+		candidates: candidates,
+	}
+}
+
+// DiscoverCA returns the cluster's CA certificate, probing a freshly
+// scheduled agent pod the first time it's called and returning the cached
+// result on subsequent calls.
+func (a *Agent) DiscoverCA() (*Result, error) {
+	if a.cached != nil {
+		return a.cached, nil
+	}
+
+	nodeName, err := a.findControlPlaneNode()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	pod, err := a.createAgentPod(nodeName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer func() {
+		if err := a.client.Core().Pods(AgentNamespace).Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+			log.Warningf("certagent: failed to clean up agent pod %v/%v: %v", AgentNamespace, pod.Name, err)
+		}
+	}()
+
+	if err := a.waitForPodRunning(pod.Name); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	for _, path := range a.candidates {
+		out, err := a.exec(a.kubeConfig, pod.Name, AgentNamespace, agentContainerName, []string{"cat", path})
+		if err != nil {
+			log.Debugf("certagent: agent pod has no CA at %v: %v", path, err)
+			continue
+		}
+		if len(bytes.TrimSpace(out)) == 0 {
+			continue
+		}
+		a.cached = &Result{CertPEM: out, Node: nodeName, Path: path}
+		return a.cached, nil
+	}
+	return nil, trace.NotFound("could not find kube CA on node %v in any of %v", nodeName, a.candidates)
+}
+
+// findControlPlaneNode returns the name of a node running the Kubernetes
+// control plane, identified by one of its pods carrying
+// ControllerManagerLabel.
+func (a *Agent) findControlPlaneNode() (string, error) {
+	pods, err := a.client.Core().Pods("kube-system").List(metav1.ListOptions{
+		LabelSelector: ControllerManagerLabel.AsSelector().String(),
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != "" {
+			return pod.Spec.NodeName, nil
+		}
+	}
+	return "", trace.NotFound("no controller-manager pod is scheduled onto a node, can't discover kube CA")
+}
+
+// createAgentPod schedules the agent's own pod onto nodeName, hostPath
+// mounting the parent directory of every candidate CA path so the
+// candidates can be read out of a.exec'ing into a known-good image rather
+// than the (possibly distroless) control-plane container.
+func (a *Agent) createAgentPod(nodeName string) (*v1.Pod, error) {
+	hostPathType := v1.HostPathDirectoryOrCreate
+	dirs := map[string]bool{}
+	var volumes []v1.Volume
+	var mounts []v1.VolumeMount
+	for _, path := range a.candidates {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		name := fmt.Sprintf("ca-dir-%v", len(volumes))
+		volumes = append(volumes, v1.Volume{
+			Name: name,
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: dir, Type: &hostPathType},
+			},
+		})
+		mounts = append(mounts, v1.VolumeMount{Name: name, MountPath: dir, ReadOnly: true})
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "teleport-kube-cert-agent-",
+			Namespace:    AgentNamespace,
+		},
+		Spec: v1.PodSpec{
+			NodeName:      nodeName,
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{
+				{
+					Name:         agentContainerName,
+					Image:        AgentImage,
+					Command:      []string{"/bin/sh", "-c", "sleep 3600"},
+					VolumeMounts: mounts,
+				},
+			},
+			Volumes: volumes,
+		},
+	}
+	created, err := a.client.Core().Pods(AgentNamespace).Create(pod)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return created, nil
+}
+
+// waitForPodRunning polls podName until it reaches the Running phase or
+// agentPodTimeout elapses.
+func (a *Agent) waitForPodRunning(podName string) error {
+	err := wait.PollImmediate(time.Second, agentPodTimeout, func() (bool, error) {
+		pod, err := a.client.Core().Pods(AgentNamespace).Get(podName, metav1.GetOptions{})
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		return pod.Status.Phase == v1.PodRunning, nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "agent pod %v/%v did not reach Running", AgentNamespace, podName)
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package proxy implements the Teleport Kubernetes proxy: it terminates
+// the client's Teleport-issued mTLS connection, works out which upstream
+// cluster and apiserver a request is for, and re-dials it re-presenting a
+// Teleport-minted client cert of its own (or, in ProxyModeImpersonation, a
+// service account token plus Impersonate-* headers).
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/kube"
+	"github.com/gravitational/teleport/lib/kube/certagent"
+	"github.com/gravitational/teleport/lib/session"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// KubeClusterHeader carries the name of the Teleport cluster (root or a
+// trusted leaf) a request should be routed to. It plays the same role for
+// kube requests that SNI-based routing plays for SSH reverse tunnels: the
+// client picks a destination cluster, the root proxy dispatches to it.
+const KubeClusterHeader = "X-Teleport-Kube-Cluster"
+
+// IssueClientCertFunc mints a short-lived client certificate scoped to
+// kubeUsers/kubeGroups for the proxy to present to the real apiserver,
+// signed by (or otherwise trusted via a webhook token authenticator by)
+// the upstream cluster.
+type IssueClientCertFunc func(kubeUsers, kubeGroups []string) (certPEM, keyPEM []byte, err error)
+
+// Cluster describes how to reach one Teleport cluster's real Kubernetes
+// apiserver.
+type Cluster struct {
+	// Name is the Teleport cluster name.
+	Name string
+	// KubeConfig points at the real apiserver for this cluster.
+	KubeConfig *rest.Config
+	// IssueClientCert mints the client cert the proxy presents to this
+	// cluster's apiserver.
+	IssueClientCert IssueClientCertFunc
+}
+
+// Config configures a kube proxy Server.
+type Config struct {
+	// ProxyMode selects how the proxy authenticates to upstream apiservers.
+	ProxyMode kube.ProxyMode
+	// LocalCluster is the Teleport cluster name this proxy belongs to -
+	// where a request with no KubeClusterHeader is routed. It must be one
+	// of the keys of Clusters.
+	LocalCluster string
+	// Clusters is the set of clusters this proxy can route to, keyed by
+	// Teleport cluster name. It is fixed when New is called: Server has no
+	// method to add a trusted leaf cluster afterwards.
+	Clusters map[string]Cluster
+	// CertAgents discovers and caches each cluster's upstream CA in every
+	// ProxyMode other than ProxyModeImpersonation. Keyed the same way as
+	// Clusters. It is the only source of the upstream CA in those modes:
+	// the CA data in a Cluster's KubeConfig is not used, and a cluster with
+	// no agent here cannot be dialed.
+	CertAgents map[string]*certagent.Agent
+	// ImpersonationServiceAccountToken authenticates the proxy to upstream
+	// apiservers when ProxyMode is ProxyModeImpersonation.
+	ImpersonationServiceAccountToken string
+	// AuditLog receives session recording events for proxied exec/attach
+	// sessions. May be nil, in which case sessions are not recorded.
+	AuditLog events.IAuditLog
+	// SessionRecording gates where proxied exec/attach sessions are
+	// recorded. SessionRecordingModeProxy records them here, in
+	// hijackAndStream; SessionRecordingModeOff and SessionRecordingModeNode
+	// both mean this proxy doesn't record them, whether because recording
+	// is disabled entirely or because the node they're proxied to records
+	// them instead.
+	SessionRecording events.SessionRecordingMode
+}
+
+// Server is the Teleport kube proxy.
+type Server struct {
+	cfg Config
+
+	mu          sync.Mutex
+	upstreamCAs map[string]discoveredCA
+}
+
+type discoveredCA struct {
+	pem  []byte
+	pool *x509.CertPool
+}
+
+// New returns a kube proxy Server for cfg.
+func New(cfg Config) *Server {
+	return &Server{
+		cfg:         cfg,
+		upstreamCAs: make(map[string]discoveredCA),
+	}
+}
+
+// SetAuditLog wires up (or replaces) the audit log that session recordings
+// are emitted to. The proxy typically only has an audit log client once it
+// has connected to the auth server, so this is often called after New,
+// once that connection is established. Until it's called, sessions are not
+// recorded.
+func (s *Server) SetAuditLog(log events.IAuditLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.AuditLog = log
+}
+
+func (s *Server) auditLog() events.IAuditLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg.AuditLog
+}
+
+// UpstreamCA returns the CA pool the proxy trusts when dialing
+// clusterName's apiserver, discovering it via CertAgents on first use and
+// caching the result.
+func (s *Server) UpstreamCA(clusterName string) (*x509.CertPool, error) {
+	ca, err := s.discoverCA(clusterName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return ca.pool, nil
+}
+
+// UpstreamCAPEM returns the raw PEM bytes of the CA the proxy discovered
+// (and is trusting) for clusterName.
+func (s *Server) UpstreamCAPEM(clusterName string) ([]byte, error) {
+	ca, err := s.discoverCA(clusterName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return ca.pem, nil
+}
+
+func (s *Server) discoverCA(clusterName string) (discoveredCA, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ca, ok := s.upstreamCAs[clusterName]; ok {
+		return ca, nil
+	}
+
+	agent, ok := s.cfg.CertAgents[clusterName]
+	if !ok {
+		return discoveredCA{}, trace.NotFound("no cert agent configured for cluster %q", clusterName)
+	}
+	result, err := agent.DiscoverCA()
+	if err != nil {
+		return discoveredCA{}, trace.Wrap(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(result.CertPEM) {
+		return discoveredCA{}, trace.BadParameter("failed to parse discovered CA for cluster %q", clusterName)
+	}
+	ca := discoveredCA{pem: result.CertPEM, pool: pool}
+	s.upstreamCAs[clusterName] = ca
+	return ca, nil
+}
+
+// clusterForRequest resolves which cluster a request should be routed to:
+// the KubeClusterHeader if set, otherwise the proxy's own LocalCluster.
+// LocalCluster is an explicit config field, not inferred from Clusters,
+// because once more than one cluster is configured (the trusted-cluster
+// case) there's no reliable way to tell "the local one" apart from a
+// trusted leaf by looking at the map alone - every entry's Name matches
+// its own key.
+func (s *Server) clusterForRequest(r *http.Request) string {
+	if name := r.Header.Get(KubeClusterHeader); name != "" {
+		return name
+	}
+	return s.cfg.LocalCluster
+}
+
+// upstreamTransport builds the http.RoundTripper used to reach
+// cluster.KubeConfig.Host for r, per the proxy's configured ProxyMode.
+func (s *Server) upstreamTransport(r *http.Request, cluster Cluster) (http.RoundTripper, error) {
+	switch s.cfg.ProxyMode {
+	case kube.ProxyModeImpersonation:
+		base, err := rest.TransportFor(&rest.Config{
+			Host:            cluster.KubeConfig.Host,
+			TLSClientConfig: rest.TLSClientConfig{Insecure: cluster.KubeConfig.Insecure, CAData: cluster.KubeConfig.CAData},
+		})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		_, kubeUsers, kubeGroups := identityFromRequest(r)
+		return kube.NewImpersonationRoundTripper(base, s.cfg.ImpersonationServiceAccountToken, kubeUsers, kubeGroups, nil), nil
+	default:
+		pool, err := s.UpstreamCA(cluster.Name)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		_, kubeUsers, kubeGroups := identityFromRequest(r)
+		cert, err := s.clientCertFor(cluster, kubeUsers, kubeGroups)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		transport, ok := http.DefaultTransport.(*http.Transport)
+		if !ok {
+			transport = &http.Transport{}
+		} else {
+			transport = transport.Clone()
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}
+		return transport, nil
+	}
+}
+
+// clientCertFor mints (via cluster.IssueClientCert) the client certificate
+// the proxy presents to cluster's apiserver, scoped to kubeUsers/
+// kubeGroups.
+func (s *Server) clientCertFor(cluster Cluster, kubeUsers, kubeGroups []string) (tls.Certificate, error) {
+	if cluster.IssueClientCert == nil {
+		return tls.Certificate{}, trace.BadParameter("cluster %q has no client cert issuer configured", cluster.Name)
+	}
+	certPEM, keyPEM, err := cluster.IssueClientCert(kubeUsers, kubeGroups)
+	if err != nil {
+		return tls.Certificate{}, trace.Wrap(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, trace.Wrap(err)
+	}
+	return cert, nil
+}
+
+// identityFromRequest extracts the caller's kubernetes_users/groups and
+// Teleport login from the client cert that authenticated this request.
+func identityFromRequest(r *http.Request) (login string, kubeUsers, kubeGroups []string) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", nil, nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	return cert.Subject.CommonName, cert.Subject.Organization, cert.Subject.OrganizationalUnit
+}
+
+// ServeHTTP proxies a single kube API request to the right upstream
+// cluster. Plain (non-upgrading) requests are forwarded with
+// httputil.ReverseProxy; exec/attach/portforward requests, which upgrade
+// to SPDY, are handled by hijackAndStream so the raw, bidirectional byte
+// stream can be relayed directly.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clusterName := s.clusterForRequest(r)
+	cluster, ok := s.cfg.Clusters[clusterName]
+	if !ok {
+		http.Error(w, "unknown cluster: "+clusterName, http.StatusBadGateway)
+		return
+	}
+
+	if isUpgradeRequest(r) {
+		s.hijackAndStream(w, r, cluster)
+		return
+	}
+
+	transport, err := s.upstreamTransport(r, cluster)
+	if err != nil {
+		http.Error(w, trace.Wrap(err).Error(), http.StatusBadGateway)
+		return
+	}
+	upstream, err := url.Parse(cluster.KubeConfig.Host)
+	if err != nil {
+		http.Error(w, trace.Wrap(err).Error(), http.StatusBadGateway)
+		return
+	}
+	rp := httputil.NewSingleHostReverseProxy(upstream)
+	rp.Transport = transport
+	rp.ServeHTTP(w, r)
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Connection"), "Upgrade")
+}
+
+// hijackAndStream handles exec/attach/portforward requests: it dials the
+// upstream apiserver directly (so the SPDY upgrade handshake happens
+// end-to-end) and splices the client and upstream connections together.
+func (s *Server) hijackAndStream(w http.ResponseWriter, r *http.Request, cluster Cluster) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, trace.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	upstream, err := url.Parse(cluster.KubeConfig.Host)
+	if err != nil {
+		return
+	}
+
+	var tlsConfig *tls.Config
+	switch s.cfg.ProxyMode {
+	case kube.ProxyModeImpersonation:
+		pool := x509.NewCertPool()
+		if len(cluster.KubeConfig.CAData) > 0 {
+			pool.AppendCertsFromPEM(cluster.KubeConfig.CAData)
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+		_, kubeUsers, kubeGroups := identityFromRequest(r)
+		headers, err := kube.ImpersonationHeaders(kubeUsers, kubeGroups, nil)
+		if err != nil {
+			log.WithError(err).Warningf("kube proxy: could not build impersonation headers for %v", cluster.Name)
+			return
+		}
+		for k, values := range headers {
+			for _, v := range values {
+				r.Header.Add(k, v)
+			}
+		}
+		r.Header.Set("Authorization", "Bearer "+s.cfg.ImpersonationServiceAccountToken)
+	default:
+		pool, err := s.UpstreamCA(cluster.Name)
+		if err != nil {
+			log.WithError(err).Warningf("kube proxy: could not load upstream CA for %v", cluster.Name)
+			return
+		}
+		_, kubeUsers, kubeGroups := identityFromRequest(r)
+		cert, err := s.clientCertFor(cluster, kubeUsers, kubeGroups)
+		if err != nil {
+			log.WithError(err).Warningf("kube proxy: could not issue client cert for %v", cluster.Name)
+			return
+		}
+		tlsConfig = &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}
+	}
+
+	upstreamConn, err := tls.Dial("tcp", upstream.Host, tlsConfig)
+	if err != nil {
+		log.WithError(err).Warningf("kube proxy: could not dial upstream %v", upstream.Host)
+		return
+	}
+	defer upstreamConn.Close()
+
+	if err := r.Write(upstreamConn); err != nil {
+		return
+	}
+
+	clientToUpstream := io.Writer(upstreamConn)
+	upstreamToClient := io.Writer(clientConn)
+
+	if rec := s.recorderFor(r); rec != nil {
+		rec.Start()
+		clientToUpstream = rec.TeeWriter(upstreamConn)
+		upstreamToClient = rec.TeeWriter(clientConn)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(clientToUpstream, clientConn); done <- struct{}{} }()
+	go func() { io.Copy(upstreamToClient, upstreamConn); done <- struct{}{} }()
+	<-done
+}
+
+// recorderFor returns a SessionRecorder for r if SessionRecording is set to
+// record at this proxy, an audit log is configured, and r targets the exec
+// or attach subresource - or nil otherwise (e.g. for port-forward, which
+// carries no command to record, or when SessionRecording is Off or Node).
+func (s *Server) recorderFor(r *http.Request) *kube.SessionRecorder {
+	if s.cfg.SessionRecording != events.SessionRecordingModeProxy {
+		return nil
+	}
+	auditLog := s.auditLog()
+	if auditLog == nil {
+		return nil
+	}
+	pod, ns, container, command, ok := parseExecRequest(r)
+	if !ok {
+		return nil
+	}
+	login, _, _ := identityFromRequest(r)
+	return kube.NewSessionRecorder(auditLog, kube.SessionContext{
+		SessionID:    session.NewID(),
+		Login:        login,
+		Namespace:    defaults.Namespace,
+		Pod:          pod,
+		PodNamespace: ns,
+		Container:    container,
+		Command:      command,
+	})
+}
+
+// parseExecRequest pulls the pod/namespace/container/command out of an
+// /api/v1/namespaces/{ns}/pods/{pod}/exec (or /attach) request URL.
+func parseExecRequest(r *http.Request) (pod, namespace, container string, command []string, ok bool) {
+	// {"api", "v1", "namespaces", ns, "pods", pod, "exec"|"attach"}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 7 || parts[0] != "api" || parts[2] != "namespaces" || parts[4] != "pods" {
+		return "", "", "", nil, false
+	}
+	if parts[6] != "exec" && parts[6] != "attach" {
+		return "", "", "", nil, false
+	}
+	namespace, pod = parts[3], parts[5]
+	container = r.URL.Query().Get("container")
+	command = r.URL.Query()["command"]
+	return pod, namespace, container, command, true
+}
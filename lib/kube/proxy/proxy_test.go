@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// fakeAuditLog is a stand-in events.IAuditLog for tests that only need to
+// tell a configured audit log apart from a nil one - recorderFor never
+// calls any of its methods, it just checks whether one is set.
+type fakeAuditLog struct {
+	events.IAuditLog
+}
+
+func execRequest() *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/default/pods/test/exec?container=test&command=/bin/sh", nil)
+}
+
+func TestRecorderForGatesOnSessionRecordingMode(t *testing.T) {
+	tests := []struct {
+		mode     events.SessionRecordingMode
+		auditLog events.IAuditLog
+		wantNil  bool
+	}{
+		{mode: events.SessionRecordingModeProxy, auditLog: &fakeAuditLog{}, wantNil: false},
+		{mode: events.SessionRecordingModeProxy, auditLog: nil, wantNil: true},
+		{mode: events.SessionRecordingModeOff, auditLog: &fakeAuditLog{}, wantNil: true},
+		{mode: events.SessionRecordingModeNode, auditLog: &fakeAuditLog{}, wantNil: true},
+	}
+
+	for _, tt := range tests {
+		s := New(Config{SessionRecording: tt.mode, AuditLog: tt.auditLog})
+		rec := s.recorderFor(execRequest())
+		if tt.wantNil && rec != nil {
+			t.Errorf("mode=%v auditLog set=%v: recorderFor returned non-nil, want nil", tt.mode, tt.auditLog != nil)
+		}
+		if !tt.wantNil && rec == nil {
+			t.Errorf("mode=%v auditLog set=%v: recorderFor returned nil, want non-nil", tt.mode, tt.auditLog != nil)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kube contains the pieces of the Teleport kube proxy that are
+// shared between the proxy itself and its integration tests.
+package kube
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/session"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionContext identifies the exec/attach session being recorded.
+type SessionContext struct {
+	// SessionID is the ID this recording's KubernetesExecEvent, session
+	// chunks and print events are all filed under.
+	SessionID session.ID
+	// Login is the Teleport identity that started the session.
+	Login string
+	// Namespace is the Teleport namespace the session belongs to.
+	Namespace string
+	// Pod, PodNamespace and Container identify the target of the exec.
+	Pod          string
+	PodNamespace string
+	Container    string
+	// Command is the command that was executed, if any (attach sessions
+	// have none).
+	Command []string
+}
+
+// SessionRecorder tees the stdout/stderr of a proxied kube exec/attach
+// session into the cluster's audit log, the same way SSH sessions are
+// captured by the node. It is safe to share across the stdout and stderr
+// tee readers of a single session.
+type SessionRecorder struct {
+	mu         sync.Mutex
+	audit      events.IAuditLog
+	ctx        SessionContext
+	chunkIndex int64
+}
+
+// NewSessionRecorder returns a recorder that will write session chunks to
+// audit under ctx.SessionID.
+func NewSessionRecorder(audit events.IAuditLog, ctx SessionContext) *SessionRecorder {
+	return &SessionRecorder{
+		audit: audit,
+		ctx:   ctx,
+	}
+}
+
+// Start emits the KubernetesExecEvent that marks the beginning of the
+// recording, carrying the pod/namespace/container/command metadata that
+// TestKubeProxy and TestKubeSessionRecording check for.
+func (r *SessionRecorder) Start() error {
+	return trace.Wrap(r.audit.EmitAuditEvent(events.KubernetesExecEvent, events.EventFields{
+		events.SessionEventID:      string(r.ctx.SessionID),
+		events.EventLogin:          r.ctx.Login,
+		events.KubernetesPod:       r.ctx.Pod,
+		events.KubernetesNamespace: r.ctx.PodNamespace,
+		events.KubernetesContainer: r.ctx.Container,
+		events.KubernetesCommand:   strings.Join(r.ctx.Command, " "),
+	}))
+}
+
+// TeeWriter wraps w so that everything written to it is also recorded
+// into the audit log as a session print event.
+func (r *SessionRecorder) TeeWriter(w io.Writer) io.Writer {
+	return &teeWriter{SessionRecorder: r, w: w}
+}
+
+// TeeReader wraps rd so that everything read from it (e.g. client stdin)
+// is also recorded into the audit log as a session print event.
+func (r *SessionRecorder) TeeReader(rd io.Reader) io.Reader {
+	return &teeReader{SessionRecorder: r, r: rd}
+}
+
+// emitPrint records a chunk of session output: the raw bytes go to the
+// chunk store via PostSessionSlice (what GetSessionChunk/tsh play read
+// back), and a SessionPrintEvent marks its place in the session's event
+// timeline, the same split SSH session recording uses.
+func (r *SessionRecorder) emitPrint(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chunkIndex := r.chunkIndex
+	r.chunkIndex++
+
+	if err := r.audit.PostSessionSlice(events.SessionSlice{
+		Namespace: r.ctx.Namespace,
+		SessionID: string(r.ctx.SessionID),
+		Chunks: []*events.SessionChunk{
+			{
+				Time:       time.Now().UTC().UnixNano(),
+				EventIndex: chunkIndex,
+				EventType:  events.SessionPrintEvent,
+				Data:       data,
+			},
+		},
+		Version: events.V2,
+	}); err != nil {
+		log.WithError(err).Warningf("kube session recorder: failed to persist session chunk for %v", r.ctx.SessionID)
+	}
+
+	if err := r.audit.EmitAuditEvent(events.SessionPrintEvent, events.EventFields{
+		events.SessionEventID: string(r.ctx.SessionID),
+		events.EventTime:      time.Now().UTC(),
+		events.DataLen:        len(data),
+	}); err != nil {
+		log.WithError(err).Warningf("kube session recorder: failed to emit print event for %v", r.ctx.SessionID)
+	}
+}
+
+type teeWriter struct {
+	*SessionRecorder
+	w io.Writer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		t.emitPrint(p[:n])
+	}
+	return n, trace.Wrap(err)
+}
+
+type teeReader struct {
+	*SessionRecorder
+	r io.Reader
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.emitPrint(p[:n])
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}